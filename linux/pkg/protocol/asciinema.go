@@ -1,6 +1,7 @@
 package protocol
 
 import (
+	"bufio"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -9,23 +10,73 @@ import (
 	"time"
 )
 
+// Supported asciinema recording format versions. V1 is vibetunnel's original
+// internal format (arbitrary env map, "r" resize events on the wire). V2 is
+// the asciinema v2 cast format (https://docs.asciinema.org/manual/asciicast/v2/),
+// which third-party players and `asciinema play` understand without conversion.
+const (
+	FormatVersion1 uint32 = 1
+	FormatVersion2 uint32 = 2
+
+	// CurrentFormatVersion is what WriteHeader fills in when a header doesn't
+	// specify a version. Readers treat a version-less header as FormatVersion1.
+	CurrentFormatVersion = FormatVersion2
+)
+
+// v2EnvKeys is the subset of environment variables the asciinema v2 spec
+// recommends recording in the header (asciicast players only ever look at
+// these two), so v2 headers never leak the full process environment.
+var v2EnvKeys = []string{"SHELL", "TERM"}
+
+// AsciinemaTheme carries the optional v2 "theme" header field, a 16-color
+// terminal palette plus foreground/background used by players that don't
+// want to guess colors from the recording.
+type AsciinemaTheme struct {
+	Fg      string `json:"fg,omitempty"`
+	Bg      string `json:"bg,omitempty"`
+	Palette string `json:"palette,omitempty"`
+}
+
 type AsciinemaHeader struct {
-	Version   uint32            `json:"version"`
-	Width     uint32            `json:"width"`
-	Height    uint32            `json:"height"`
-	Timestamp int64             `json:"timestamp,omitempty"`
-	Command   string            `json:"command,omitempty"`
-	Title     string            `json:"title,omitempty"`
-	Env       map[string]string `json:"env,omitempty"`
+	Version       uint32            `json:"version"`
+	Width         uint32            `json:"width"`
+	Height        uint32            `json:"height"`
+	Timestamp     int64             `json:"timestamp,omitempty"`
+	Command       string            `json:"command,omitempty"`
+	Title         string            `json:"title,omitempty"`
+	Env           map[string]string `json:"env,omitempty"`
+	IdleTimeLimit float64           `json:"idle_time_limit,omitempty"`
+	Theme         *AsciinemaTheme   `json:"theme,omitempty"`
+}
+
+// sanitizeEnv returns the env map that should be written for the header's
+// format version: v1 keeps whatever the caller set, v2 is restricted to the
+// spec's recommended subset so recordings stay portable.
+func sanitizeEnv(version uint32, env map[string]string) map[string]string {
+	if version != FormatVersion2 || env == nil {
+		return env
+	}
+
+	filtered := make(map[string]string, len(v2EnvKeys))
+	for _, key := range v2EnvKeys {
+		if v, ok := env[key]; ok {
+			filtered[key] = v
+		}
+	}
+	if len(filtered) == 0 {
+		return nil
+	}
+	return filtered
 }
 
 type EventType string
 
 const (
-	EventOutput EventType = "o"
-	EventInput  EventType = "i"
-	EventResize EventType = "r"
-	EventMarker EventType = "m"
+	EventOutput  EventType = "o"
+	EventInput   EventType = "i"
+	EventResize  EventType = "r"
+	EventMarker  EventType = "m"
+	EventControl EventType = "c"
 )
 
 type AsciinemaEvent struct {
@@ -41,8 +92,37 @@ type StreamEvent struct {
 	Message string           `json:"message,omitempty"`
 }
 
+// DefaultCoalesceDelay is how long the coalescing writer goroutine waits for
+// more events to arrive before flushing a batch, when the writer isn't constructed with an
+// explicit delay via NewStreamWriterWithCoalesceDelay.
+const DefaultCoalesceDelay = time.Millisecond
+
+// eventQueueSize bounds how many pending events writeEvent may have enqueued
+// ahead of the coalescing goroutine before a send blocks the caller.
+const eventQueueSize = 256
+
+// pendingEvent is an event queued for the coalescing writer goroutine. Time
+// is captured at enqueue (writeEvent/scheduleFlush time), not at flush time,
+// so batching never skews recorded timestamps.
+type pendingEvent struct {
+	elapsed float64
+	typ     EventType
+	data    []byte
+}
+
+// BatchMetrics reports how writeEvent's coalescing loop is batching writes,
+// for operators tuning the delay passed to NewStreamWriterWithCoalesceDelay.
+type BatchMetrics struct {
+	Batches          uint64
+	Events           uint64
+	LastBatchSize    int
+	LastBatchLatency time.Duration
+}
+
 type StreamWriter struct {
 	writer       io.Writer
+	bw           *bufio.Writer
+	ioMu         sync.Mutex // serializes writes to bw (header writes vs. batch flushes)
 	header       *AsciinemaHeader
 	startTime    time.Time
 	mutex        sync.Mutex
@@ -51,19 +131,41 @@ type StreamWriter struct {
 	escapeParser *EscapeParser
 	lastWrite    time.Time
 	flushTimer   *time.Timer
-	syncTimer    *time.Timer
-	needsSync    bool
+
+	coalesceDelay time.Duration
+	events        chan pendingEvent
+	wg            sync.WaitGroup
+
+	metricsMu sync.Mutex
+	metrics   BatchMetrics
 }
 
 func NewStreamWriter(writer io.Writer, header *AsciinemaHeader) *StreamWriter {
-	return &StreamWriter{
-		writer:       writer,
-		header:       header,
-		startTime:    time.Now(),
-		buffer:       make([]byte, 0, 4096),
-		escapeParser: NewEscapeParser(),
-		lastWrite:    time.Now(),
+	return newStreamWriter(writer, header, DefaultCoalesceDelay)
+}
+
+// NewStreamWriterWithCoalesceDelay is like NewStreamWriter but lets callers
+// tune how long pending events are batched before a single flush, trading
+// latency for fewer write/fsync syscalls under high-throughput output.
+func NewStreamWriterWithCoalesceDelay(writer io.Writer, header *AsciinemaHeader, delay time.Duration) *StreamWriter {
+	return newStreamWriter(writer, header, delay)
+}
+
+func newStreamWriter(writer io.Writer, header *AsciinemaHeader, coalesceDelay time.Duration) *StreamWriter {
+	w := &StreamWriter{
+		writer:        writer,
+		bw:            bufio.NewWriter(writer),
+		header:        header,
+		startTime:     time.Now(),
+		buffer:        make([]byte, 0, 4096),
+		escapeParser:  NewEscapeParser(),
+		lastWrite:     time.Now(),
+		coalesceDelay: coalesceDelay,
+		events:        make(chan pendingEvent, eventQueueSize),
 	}
+	w.wg.Add(1)
+	go w.run()
+	return w
 }
 
 func (w *StreamWriter) WriteHeader() error {
@@ -77,14 +179,24 @@ func (w *StreamWriter) WriteHeader() error {
 	if w.header.Timestamp == 0 {
 		w.header.Timestamp = w.startTime.Unix()
 	}
+	if w.header.Version == 0 {
+		w.header.Version = CurrentFormatVersion
+	}
+	w.header.Env = sanitizeEnv(w.header.Version, w.header.Env)
 
 	data, err := json.Marshal(w.header)
 	if err != nil {
 		return err
 	}
 
-	_, err = fmt.Fprintf(w.writer, "%s\n", data)
-	return err
+	// The header is written synchronously, outside of the event coalescing
+	// path, so it's guaranteed to be on the wire before any event.
+	w.ioMu.Lock()
+	defer w.ioMu.Unlock()
+	if _, err := fmt.Fprintf(w.bw, "%s\n", data); err != nil {
+		return err
+	}
+	return w.bw.Flush()
 }
 
 func (w *StreamWriter) WriteOutput(data []byte) error {
@@ -96,8 +208,44 @@ func (w *StreamWriter) WriteInput(data []byte) error {
 }
 
 func (w *StreamWriter) WriteResize(width, height uint32) error {
-	data := fmt.Sprintf("%dx%d", width, height)
-	return w.writeEvent(EventResize, []byte(data))
+	w.mutex.Lock()
+	version := w.header.Version
+	w.mutex.Unlock()
+
+	if version == FormatVersion1 {
+		data := fmt.Sprintf("%dx%d", width, height)
+		return w.writeEvent(EventResize, []byte(data))
+	}
+
+	// v2 recordings only allow "o"/"i" tuples on the wire (no "r" event),
+	// so report the resize as a real XTWINOPS "resize window" escape
+	// sequence inside an output event instead. Any terminal — and so
+	// asciinema play and third-party players — applies this like a live
+	// resize, with nothing vibetunnel-specific to decode.
+	seq := fmt.Sprintf("\x1b[8;%d;%dt", height, width)
+	return w.writeEvent(EventOutput, []byte(seq))
+}
+
+// xtwinopsResize recognizes the XTWINOPS escape sequence WriteResize emits
+// for v2 recordings in place of a dedicated resize event, so readers can
+// still surface resizes as a typed ResizeEvent/EventResize regardless of
+// which format version wrote the file.
+func xtwinopsResize(data string) (width, height uint32, ok bool) {
+	var h, w uint32
+	if n, err := fmt.Sscanf(data, "\x1b[8;%d;%dt", &h, &w); err != nil || n != 2 {
+		return 0, 0, false
+	}
+	if data != fmt.Sprintf("\x1b[8;%d;%dt", h, w) {
+		return 0, 0, false
+	}
+	return w, h, true
+}
+
+// Metrics returns a snapshot of the coalescing loop's batching behavior.
+func (w *StreamWriter) Metrics() BatchMetrics {
+	w.metricsMu.Lock()
+	defer w.metricsMu.Unlock()
+	return w.metrics
 }
 
 func (w *StreamWriter) writeEvent(eventType EventType, data []byte) error {
@@ -124,26 +272,10 @@ func (w *StreamWriter) writeEvent(eventType EventType, data []byte) error {
 		return nil
 	}
 
+	// Capture the timestamp now, at enqueue, so coalescing later doesn't
+	// skew when this event appears to have happened.
 	elapsed := time.Since(w.startTime).Seconds()
-	event := []interface{}{elapsed, string(eventType), string(processedData)}
-
-	eventData, err := json.Marshal(event)
-	if err != nil {
-		return err
-	}
-
-	_, err = fmt.Fprintf(w.writer, "%s\n", eventData)
-	if err != nil {
-		return err
-	}
-
-	// Immediately flush if the writer supports it for real-time output
-	if flusher, ok := w.writer.(interface{ Flush() error }); ok {
-		flusher.Flush()
-	}
-
-	// Schedule sync instead of immediate sync for better performance
-	w.scheduleBatchSync()
+	w.events <- pendingEvent{elapsed: elapsed, typ: eventType, data: processedData}
 
 	return nil
 }
@@ -178,87 +310,105 @@ func (w *StreamWriter) scheduleFlush() {
 
 		// Force flush incomplete data for real-time streaming
 		elapsed := time.Since(w.startTime).Seconds()
-		event := []interface{}{elapsed, string(EventOutput), string(dataToWrite)}
-
-		eventData, err := json.Marshal(event)
-		if err != nil {
-			return
-		}
-
-		if _, err := fmt.Fprintf(w.writer, "%s\n", eventData); err != nil {
-			// Log but don't fail - this is a best effort flush
-			// Cannot use log here as we might be in a defer/cleanup path
-			return
-		}
-
-		// Immediately flush if the writer supports it for real-time output
-		if flusher, ok := w.writer.(interface{ Flush() error }); ok {
-			flusher.Flush()
-		}
-
-		// Schedule sync instead of immediate sync for better performance
-		w.scheduleBatchSync()
+		w.events <- pendingEvent{elapsed: elapsed, typ: EventOutput, data: dataToWrite}
 
 		// Clear buffer after flushing
 		w.buffer = w.buffer[:0]
 	})
 }
 
-// scheduleBatchSync batches sync operations to reduce I/O overhead
-func (w *StreamWriter) scheduleBatchSync() {
-	w.needsSync = true
+// run is the coalescing writer goroutine: it drains w.events, batching
+// whatever arrives within coalesceDelay of the first event in a batch, and
+// writes each batch's lines into w.bw, flushes once, and issues at most one
+// fsync per batch.
+func (w *StreamWriter) run() {
+	defer w.wg.Done()
+
+	for first, ok := <-w.events; ok; first, ok = <-w.events {
+		batch := []pendingEvent{first}
+
+		timer := time.NewTimer(w.coalesceDelay)
+	drain:
+		for {
+			select {
+			case ev, ok := <-w.events:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, ev)
+			case <-timer.C:
+				break drain
+			}
+		}
+		timer.Stop()
 
-	// Cancel existing sync timer if any
-	if w.syncTimer != nil {
-		w.syncTimer.Stop()
+		w.flushBatch(batch)
 	}
+}
 
-	// Schedule immediate sync for real-time performance
-	w.syncTimer = time.AfterFunc(0, func() {
-		if w.needsSync {
-			if file, ok := w.writer.(*os.File); ok {
-				if err := file.Sync(); err != nil {
-					// Sync failed - this is not critical for streaming operations
-					// Using fmt instead of log to avoid potential deadlock in timer context
-					fmt.Fprintf(os.Stderr, "Warning: Failed to sync asciinema file: %v\n", err)
-				}
-			}
-			w.needsSync = false
+func (w *StreamWriter) flushBatch(batch []pendingEvent) {
+	start := time.Now()
+
+	w.ioMu.Lock()
+	for _, ev := range batch {
+		line, err := json.Marshal([]interface{}{ev.elapsed, string(ev.typ), string(ev.data)})
+		if err != nil {
+			continue
 		}
-	})
+		w.bw.Write(line)
+		w.bw.WriteByte('\n')
+	}
+	if err := w.bw.Flush(); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Failed to flush asciinema batch: %v\n", err)
+	} else if file, ok := w.writer.(*os.File); ok {
+		if err := file.Sync(); err != nil {
+			// Sync failed - this is not critical for streaming operations
+			fmt.Fprintf(os.Stderr, "Warning: Failed to sync asciinema file: %v\n", err)
+		}
+	}
+	w.ioMu.Unlock()
+
+	w.metricsMu.Lock()
+	w.metrics.Batches++
+	w.metrics.Events += uint64(len(batch))
+	w.metrics.LastBatchSize = len(batch)
+	w.metrics.LastBatchLatency = time.Since(start)
+	w.metricsMu.Unlock()
 }
 
 func (w *StreamWriter) Close() error {
 	w.mutex.Lock()
-	defer w.mutex.Unlock()
 
 	if w.closed {
+		w.mutex.Unlock()
 		return nil
 	}
+	w.closed = true
 
-	// Cancel timers
+	// Cancel timer
 	if w.flushTimer != nil {
 		w.flushTimer.Stop()
 	}
-	if w.syncTimer != nil {
-		w.syncTimer.Stop()
-	}
 
 	// Flush any remaining data from escape parser
 	flushedData := w.escapeParser.Flush()
 	finalData := append(flushedData, w.buffer...)
+	w.buffer = w.buffer[:0]
 
 	if len(finalData) > 0 {
 		elapsed := time.Since(w.startTime).Seconds()
-		event := []interface{}{elapsed, string(EventOutput), string(finalData)}
-		eventData, _ := json.Marshal(event)
-		if _, err := fmt.Fprintf(w.writer, "%s\n", eventData); err != nil {
-			// Write failed during close - log to stderr to avoid deadlock
-			fmt.Fprintf(os.Stderr, "Warning: Failed to write final asciinema event: %v\n", err)
-		}
+		w.events <- pendingEvent{elapsed: elapsed, typ: EventOutput, data: finalData}
 	}
 
-	w.closed = true
+	// Safe to close here: w.closed is now true under w.mutex, and every
+	// sender (writeEvent, scheduleFlush) checks w.closed under the same
+	// lock before sending, so no send can race with this close.
+	close(w.events)
+	w.mutex.Unlock()
+
+	// Wait for the coalescing goroutine to flush everything queued above.
+	w.wg.Wait()
+
 	if closer, ok := w.writer.(io.Closer); ok {
 		return closer.Close()
 	}
@@ -310,12 +460,38 @@ func NewStreamReader(reader io.Reader) *StreamReader {
 	}
 }
 
+// newMidStreamReader creates a StreamReader for a reader already positioned
+// just past the header (e.g. after seeking to an IndexEntry's byte offset),
+// reusing the already-known header instead of expecting to decode one.
+func newMidStreamReader(reader io.Reader, header *AsciinemaHeader) *StreamReader {
+	return &StreamReader{
+		reader:     reader,
+		decoder:    json.NewDecoder(reader),
+		header:     header,
+		headerRead: true,
+	}
+}
+
+// Version reports the format version of the recording, auto-detected from
+// the header by Next. It returns 0 until the header has been read.
+func (r *StreamReader) Version() uint32 {
+	if r.header == nil {
+		return 0
+	}
+	return r.header.Version
+}
+
 func (r *StreamReader) Next() (*StreamEvent, error) {
 	if !r.headerRead {
 		var header AsciinemaHeader
 		if err := r.decoder.Decode(&header); err != nil {
 			return nil, err
 		}
+		if header.Version == 0 {
+			// Recordings written before version tagging was introduced are
+			// treated as v1 so existing vibetunnel recordings keep decoding.
+			header.Version = FormatVersion1
+		}
 		r.header = &header
 		r.headerRead = true
 		return &StreamEvent{
@@ -356,6 +532,23 @@ func (r *StreamReader) Next() (*StreamEvent, error) {
 		return nil, fmt.Errorf("invalid event data")
 	}
 
+	// v2 recordings carry resizes as an XTWINOPS sequence inside an "o"
+	// event rather than a dedicated "r" event (see WriteResize); surface
+	// it as a typed resize event either way, so callers get the same
+	// shape regardless of which format version produced the recording.
+	if r.header != nil && r.header.Version == FormatVersion2 && EventType(eventType) == EventOutput {
+		if width, height, ok := xtwinopsResize(data); ok {
+			return &StreamEvent{
+				Type: "event",
+				Event: &AsciinemaEvent{
+					Time: timestamp,
+					Type: EventResize,
+					Data: fmt.Sprintf("%dx%d", width, height),
+				},
+			}, nil
+		}
+	}
+
 	return &StreamEvent{
 		Type: "event",
 		Event: &AsciinemaEvent{
@@ -365,3 +558,27 @@ func (r *StreamReader) Next() (*StreamEvent, error) {
 		},
 	}, nil
 }
+
+// NextMessage is the typed counterpart to Next: it decodes the same
+// underlying NDJSON wire format but returns a Message (HeaderMessage,
+// OutputEvent, ResizeEvent, ControlMessage, ...) instead of the
+// string-typed StreamEvent/AsciinemaEvent pair, sharing decodeEventTuple
+// with NDJSONStream so both readers agree on what the wire format means —
+// including treating a v2 recording's XTWINOPS-in-"o" resize encoding as a
+// ResizeEvent, the same as Next does.
+func (r *StreamReader) NextMessage() (Message, error) {
+	if !r.headerRead {
+		var header AsciinemaHeader
+		if err := r.decoder.Decode(&header); err != nil {
+			return nil, err
+		}
+		if header.Version == 0 {
+			header.Version = FormatVersion1
+		}
+		r.header = &header
+		r.headerRead = true
+		return HeaderMessage{Header: header}, nil
+	}
+
+	return decodeEventTuple(r.decoder, r.header.Version)
+}
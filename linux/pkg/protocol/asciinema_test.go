@@ -0,0 +1,90 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// writeAndRead runs header + resize + output through a StreamWriter at the
+// given version and returns a StreamReader over the result plus the raw
+// bytes, so callers can read it back via both Next and NextMessage and a
+// mismatch between the two accessors (chunk0-1) shows up immediately.
+func writeAndRead(t *testing.T, version uint32) (*StreamReader, *bytes.Buffer) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w := NewStreamWriterWithCoalesceDelay(&buf, &AsciinemaHeader{Version: version, Width: 80, Height: 24}, time.Millisecond)
+	if err := w.WriteHeader(); err != nil {
+		t.Fatalf("WriteHeader: %v", err)
+	}
+	if err := w.WriteResize(100, 40); err != nil {
+		t.Fatalf("WriteResize: %v", err)
+	}
+	if err := w.WriteOutput([]byte("hello\n")); err != nil {
+		t.Fatalf("WriteOutput: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	return NewStreamReader(bytes.NewReader(buf.Bytes())), &buf
+}
+
+func TestStreamResizeRoundTripV1(t *testing.T) {
+	r, _ := writeAndRead(t, FormatVersion1)
+
+	if ev, err := r.Next(); err != nil || ev.Type != "header" {
+		t.Fatalf("Next header: %v, %+v", err, ev)
+	}
+
+	ev, err := r.Next()
+	if err != nil {
+		t.Fatalf("Next resize: %v", err)
+	}
+	if ev.Type != "event" || ev.Event.Type != EventResize || ev.Event.Data != "100x40" {
+		t.Fatalf("expected resize event 100x40, got %+v", ev)
+	}
+}
+
+func TestStreamResizeRoundTripV2(t *testing.T) {
+	r, _ := writeAndRead(t, FormatVersion2)
+
+	if ev, err := r.Next(); err != nil || ev.Type != "header" {
+		t.Fatalf("Next header: %v, %+v", err, ev)
+	}
+
+	ev, err := r.Next()
+	if err != nil {
+		t.Fatalf("Next resize: %v", err)
+	}
+	if ev.Type != "event" || ev.Event.Type != EventResize || ev.Event.Data != "100x40" {
+		t.Fatalf("expected resize event 100x40 from XTWINOPS, got %+v", ev)
+	}
+}
+
+// TestNextMessageAgreesWithNext guards against the chunk0-1 regression where
+// NextMessage returned a raw OutputEvent for the same v2 XTWINOPS bytes that
+// Next already typed as a resize.
+func TestNextMessageAgreesWithNext(t *testing.T) {
+	for _, version := range []uint32{FormatVersion1, FormatVersion2} {
+		_, buf := writeAndRead(t, version)
+
+		r := NewStreamReader(bytes.NewReader(buf.Bytes()))
+		if _, err := r.NextMessage(); err != nil {
+			t.Fatalf("NextMessage header: %v", err)
+		}
+
+		msg, err := r.NextMessage()
+		if err != nil {
+			t.Fatalf("NextMessage resize (version %d): %v", version, err)
+		}
+		resize, ok := msg.(ResizeEvent)
+		if !ok {
+			t.Fatalf("version %d: NextMessage returned %T, want ResizeEvent", version, msg)
+		}
+		if resize.Width != 100 || resize.Height != 40 {
+			t.Fatalf("version %d: got resize %dx%d, want 100x40", version, resize.Width, resize.Height)
+		}
+	}
+}
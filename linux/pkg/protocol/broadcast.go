@@ -0,0 +1,281 @@
+package protocol
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// BackpressurePolicy controls what BroadcastWriter does with a subscriber
+// that can't keep up with the live event rate.
+type BackpressurePolicy int
+
+const (
+	// PolicyDropOldest discards the oldest queued event for a slow
+	// subscriber to make room for the new one. The subscriber falls behind
+	// but is never disconnected.
+	PolicyDropOldest BackpressurePolicy = iota
+	// PolicyBlock makes the whole broadcast wait for a slow subscriber to
+	// catch up. Use only when every subscriber is trusted to keep up.
+	PolicyBlock
+	// PolicyDisconnectSlow removes a subscriber as soon as its queue fills
+	// up, rather than let it affect other subscribers or the recording.
+	PolicyDisconnectSlow
+)
+
+// defaultSubscriberQueue is the number of pending events a subscriber may
+// buffer before PolicyDropOldest/PolicyDisconnectSlow kick in.
+const defaultSubscriberQueue = 256
+
+// BroadcastWriter is an io.Writer that sits in place of the underlying file
+// a StreamWriter records to (NewStreamWriter(broadcastWriter, header)) and
+// fans every write out to dynamically-added subscribers, in addition to the
+// primary recording. It lets N viewers watch a live session without each one
+// tailing the PTY directly.
+//
+// A late-joining subscriber is caught up with the recording's header plus a
+// bounded scrollback of recent writes before it starts receiving live
+// events, so it renders a coherent screen instead of a blank one.
+type BroadcastWriter struct {
+	mu sync.Mutex
+
+	primary       io.Writer
+	header        []byte
+	scrollback    [][]byte
+	scrollbackMax int
+	partial       []byte
+
+	policy BackpressurePolicy
+	subs   map[string]*broadcastSub
+	closed bool
+}
+
+// NewBroadcastWriter creates a BroadcastWriter that writes through to
+// primary (typically the recording file) and replays up to scrollback prior
+// events to each newly added subscriber.
+func NewBroadcastWriter(primary io.Writer, scrollback int, policy BackpressurePolicy) *BroadcastWriter {
+	return &BroadcastWriter{
+		primary:       primary,
+		scrollbackMax: scrollback,
+		policy:        policy,
+		subs:          make(map[string]*broadcastSub),
+	}
+}
+
+// Write implements io.Writer. A single call may carry one header/event line
+// (as StreamWriter wrote before chunk0-4), several newline-delimited lines
+// batched together by StreamWriter's coalescing writer, or a fragment of a
+// single line with no trailing newline at all — bufio.Writer splits a batch
+// across multiple underlying Write calls whenever it exceeds its own
+// buffer size, independently of how StreamWriter grouped the batch. Write
+// carries any such fragment in b.partial across calls and only treats a
+// line as complete, and counts it against header/scrollback/subscribers,
+// once a trailing newline has actually been seen.
+func (b *BroadcastWriter) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return 0, fmt.Errorf("broadcast writer closed")
+	}
+
+	n, err := b.primary.Write(p)
+	if err != nil {
+		return n, err
+	}
+
+	b.partial = append(b.partial, p...)
+	lines, rest := splitCompleteLines(b.partial)
+	b.partial = rest
+
+	for _, line := range lines {
+		if b.header == nil {
+			b.header = line
+		} else {
+			b.appendScrollback(line)
+		}
+
+		for id, sub := range b.subs {
+			if !sub.send(line) {
+				delete(b.subs, id)
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// splitCompleteLines splits buf into newline-terminated lines, each
+// returned as its own copy so subscribers and scrollback entries don't
+// alias buf's backing array, plus whatever trailing fragment has no
+// newline yet. The caller carries rest over to the next Write call instead
+// of treating it as a complete line.
+func splitCompleteLines(buf []byte) (lines [][]byte, rest []byte) {
+	start := 0
+	for i, c := range buf {
+		if c == '\n' {
+			lines = append(lines, append([]byte(nil), buf[start:i+1]...))
+			start = i + 1
+		}
+	}
+	return lines, append([]byte(nil), buf[start:]...)
+}
+
+func (b *BroadcastWriter) appendScrollback(line []byte) {
+	if b.scrollbackMax <= 0 {
+		return
+	}
+	b.scrollback = append(b.scrollback, line)
+	if excess := len(b.scrollback) - b.scrollbackMax; excess > 0 {
+		b.scrollback = b.scrollback[excess:]
+	}
+}
+
+// AddWriter registers a new subscriber, replaying the header and current
+// scrollback to it before it starts receiving live events. id must be
+// unique among currently registered subscribers.
+func (b *BroadcastWriter) AddWriter(id string, w io.Writer) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return fmt.Errorf("broadcast writer closed")
+	}
+	if _, exists := b.subs[id]; exists {
+		return fmt.Errorf("subscriber %q already added", id)
+	}
+
+	sub := newBroadcastSub(w, b.policy)
+	if b.header != nil {
+		sub.send(b.header)
+	}
+	for _, line := range b.scrollback {
+		sub.send(line)
+	}
+
+	b.subs[id] = sub
+	return nil
+}
+
+// RemoveWriter unregisters a subscriber and stops its delivery goroutine. It
+// is a no-op if id is not currently registered.
+func (b *BroadcastWriter) RemoveWriter(id string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if sub, ok := b.subs[id]; ok {
+		sub.close()
+		delete(b.subs, id)
+	}
+}
+
+// CloseWriters unregisters every subscriber. The BroadcastWriter itself
+// keeps writing to primary; only the fan-out subscribers are torn down.
+func (b *BroadcastWriter) CloseWriters() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for id, sub := range b.subs {
+		sub.close()
+		delete(b.subs, id)
+	}
+}
+
+// Close stops accepting writes, tears down all subscribers, and closes
+// primary if it implements io.Closer.
+func (b *BroadcastWriter) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	for id, sub := range b.subs {
+		sub.close()
+		delete(b.subs, id)
+	}
+	b.mu.Unlock()
+
+	if closer, ok := b.primary.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// broadcastSub delivers events to one subscriber's writer on its own
+// goroutine, so BroadcastWriter.Write only waits on a slow subscriber once
+// its queue is full and the policy is PolicyBlock; the backpressure policy
+// decides what happens when it falls behind.
+type broadcastSub struct {
+	w      io.Writer
+	policy BackpressurePolicy
+	queue  chan []byte
+	done   chan struct{}
+}
+
+func newBroadcastSub(w io.Writer, policy BackpressurePolicy) *broadcastSub {
+	s := &broadcastSub{
+		w:      w,
+		policy: policy,
+		queue:  make(chan []byte, defaultSubscriberQueue),
+		done:   make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+func (s *broadcastSub) run() {
+	for {
+		select {
+		case line, ok := <-s.queue:
+			if !ok {
+				return
+			}
+			_, _ = s.w.Write(line)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// send enqueues line for delivery, applying the subscriber's backpressure
+// policy if the queue is full. It returns false if the subscriber was
+// disconnected as a result and should be removed from the subscriber table.
+func (s *broadcastSub) send(line []byte) bool {
+	select {
+	case s.queue <- line:
+		return true
+	default:
+	}
+
+	switch s.policy {
+	case PolicyBlock:
+		select {
+		case s.queue <- line:
+			return true
+		case <-s.done:
+			return false
+		}
+	case PolicyDisconnectSlow:
+		s.close()
+		return false
+	default: // PolicyDropOldest
+		select {
+		case <-s.queue:
+		default:
+		}
+		select {
+		case s.queue <- line:
+		default:
+		}
+		return true
+	}
+}
+
+func (s *broadcastSub) close() {
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+}
@@ -0,0 +1,145 @@
+package protocol
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is an io.Writer safe for concurrent use by broadcastSub's
+// delivery goroutine and the test's assertions.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.Write(p)
+}
+
+func (s *syncBuffer) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.String()
+}
+
+// TestBroadcastWriterSplitsLineAcrossWrites guards against the chunk0-2
+// regression: bufio.Writer splits a single oversized batched line into a
+// data-only Write and a separate "\n"-only Write. BroadcastWriter must not
+// treat either fragment as a complete event on its own.
+func TestBroadcastWriterSplitsLineAcrossWrites(t *testing.T) {
+	var primary bytes.Buffer
+	bw := NewBroadcastWriter(&primary, 10, PolicyDropOldest)
+
+	sub := &syncBuffer{}
+	if err := bw.AddWriter("sub", sub); err != nil {
+		t.Fatalf("AddWriter: %v", err)
+	}
+
+	header := []byte("{\"version\":2}\n")
+	if _, err := bw.Write(header); err != nil {
+		t.Fatalf("Write header: %v", err)
+	}
+
+	// Simulate bufio.Writer overflow: a long line arrives with no trailing
+	// newline, followed by a separate Write call carrying only "\n".
+	body := []byte(`[0.1,"o","` + strings.Repeat("x", 6000) + `"]`)
+	if _, err := bw.Write(body); err != nil {
+		t.Fatalf("Write body: %v", err)
+	}
+	if _, err := bw.Write([]byte("\n")); err != nil {
+		t.Fatalf("Write newline: %v", err)
+	}
+
+	// Give the subscriber goroutine a moment to drain its queue.
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if strings.Count(sub.String(), "\n") >= 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	got := sub.String()
+	wantLine := string(body) + "\n"
+	if got != string(header)+wantLine {
+		t.Fatalf("subscriber got %d bytes in %d lines, want header + one %d-byte event line",
+			len(got), strings.Count(got, "\n"), len(wantLine))
+	}
+
+	scrollback := bw.scrollback
+	if len(scrollback) != 1 {
+		t.Fatalf("expected exactly one scrollback entry for the reassembled line, got %d", len(scrollback))
+	}
+}
+
+func TestBroadcastWriterScrollbackReplay(t *testing.T) {
+	var primary bytes.Buffer
+	bw := NewBroadcastWriter(&primary, 2, PolicyDropOldest)
+
+	for _, line := range []string{"a\n", "b\n", "c\n", "d\n"} {
+		if _, err := bw.Write([]byte(line)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	late := &syncBuffer{}
+	if err := bw.AddWriter("late", late); err != nil {
+		t.Fatalf("AddWriter: %v", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if late.String() != "" {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// header "a" plus the last scrollbackMax=2 entries ("c", "d"), never "b".
+	want := "a\nc\nd\n"
+	if got := late.String(); got != want {
+		t.Fatalf("late subscriber got %q, want %q", got, want)
+	}
+}
+
+func TestBroadcastWriterDisconnectSlowSubscriber(t *testing.T) {
+	var primary bytes.Buffer
+	bw := NewBroadcastWriter(&primary, 0, PolicyDisconnectSlow)
+
+	blocking := &blockingWriter{unblock: make(chan struct{})}
+	defer close(blocking.unblock)
+
+	if err := bw.AddWriter("slow", blocking); err != nil {
+		t.Fatalf("AddWriter: %v", err)
+	}
+
+	for i := 0; i < defaultSubscriberQueue+10; i++ {
+		if _, err := bw.Write([]byte("x\n")); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	bw.mu.Lock()
+	_, stillSubscribed := bw.subs["slow"]
+	bw.mu.Unlock()
+
+	if stillSubscribed {
+		t.Fatalf("expected slow subscriber to be disconnected once its queue filled")
+	}
+}
+
+// blockingWriter never returns from Write until unblock is closed, so its
+// broadcastSub queue fills up deterministically.
+type blockingWriter struct {
+	unblock chan struct{}
+}
+
+func (b *blockingWriter) Write(p []byte) (int, error) {
+	<-b.unblock
+	return len(p), nil
+}
@@ -0,0 +1,514 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// IndexFileSuffix is appended to a recording's path to name its sidecar
+// index, e.g. "session.cast" -> "session.cast.idx".
+const IndexFileSuffix = ".idx"
+
+// Default checkpoint cadence: whichever of these triggers first wins.
+const (
+	DefaultCheckpointInterval   = 5 * time.Second
+	DefaultCheckpointByteWindow = 256 * 1024
+)
+
+// TerminalCell is one cell of a reconstructed screen snapshot.
+type TerminalCell struct {
+	Rune rune `json:"r"`
+	Attr int  `json:"a,omitempty"` // first parameter of the latest SGR sequence before the cell was written, 0 if none or reset
+}
+
+// TerminalSnapshot is the minimal terminal state IndexWriter reconstructs
+// from recorded output: cursor position and a screen grid. It's gzipped and
+// stored in an IndexEntry so IndexedStreamReader can restore a coherent
+// screen without replaying from the start of the recording.
+type TerminalSnapshot struct {
+	Width     int              `json:"width"`
+	Height    int              `json:"height"`
+	CursorRow int              `json:"cursor_row"`
+	CursorCol int              `json:"cursor_col"`
+	Grid      [][]TerminalCell `json:"grid"`
+}
+
+// IndexEntry is one checkpoint in a .cast.idx sidecar: the recording
+// position it corresponds to, plus the screen snapshot at that point.
+type IndexEntry struct {
+	EventTime  float64 `json:"event_time"`
+	EventIndex int64   `json:"event_index"`
+	ByteOffset int64   `json:"byte_offset"`
+	// Snapshot is a gzip-compressed, JSON-encoded TerminalSnapshot.
+	Snapshot []byte `json:"snapshot"`
+}
+
+func decodeSnapshot(compressed []byte) (*TerminalSnapshot, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	data, err := io.ReadAll(gz)
+	if err != nil {
+		return nil, err
+	}
+
+	var snap TerminalSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, err
+	}
+	return &snap, nil
+}
+
+// terminalState is a minimal terminal emulator: just enough of the escape
+// sequence vocabulary (cursor movement, SGR attribute tracking, line
+// wrapping/scrolling) to reconstruct a plausible screen for scrubbing, not a
+// full VT100/xterm implementation.
+type terminalState struct {
+	width, height int
+	cursorRow     int
+	cursorCol     int
+	attr          int
+	grid          [][]TerminalCell
+}
+
+func newTerminalState(width, height int) *terminalState {
+	if width <= 0 {
+		width = 80
+	}
+	if height <= 0 {
+		height = 24
+	}
+	t := &terminalState{width: width, height: height}
+	t.grid = make([][]TerminalCell, height)
+	for i := range t.grid {
+		t.grid[i] = make([]TerminalCell, width)
+	}
+	return t
+}
+
+func (t *terminalState) newline() {
+	t.cursorRow++
+	if t.cursorRow >= t.height {
+		copy(t.grid, t.grid[1:])
+		t.grid[t.height-1] = make([]TerminalCell, t.width)
+		t.cursorRow = t.height - 1
+	}
+}
+
+// Feed advances terminal state by the output bytes of one event.
+func (t *terminalState) Feed(data []byte) {
+	for i := 0; i < len(data); {
+		b := data[i]
+
+		switch {
+		case b == '\n':
+			t.newline()
+			i++
+		case b == '\r':
+			t.cursorCol = 0
+			i++
+		case b == '\b':
+			if t.cursorCol > 0 {
+				t.cursorCol--
+			}
+			i++
+		case b == 0x1b && i+1 < len(data) && data[i+1] == '[':
+			consumed, final, ok := scanCSI(data[i:])
+			if ok {
+				t.applyCSI(final, data[i+2:i+consumed-1])
+			}
+			// If !ok, the CSI sequence is truncated (e.g. split across
+			// separate writes); consumed covers the rest of data so the
+			// incomplete params are never misread as printable text.
+			i += consumed
+		case b == 0x1b:
+			// Non-CSI escape sequence (or a lone trailing ESC): only the ESC
+			// byte is skipped. The bytes after it (e.g. an OSC title) are
+			// not recognized and are handled like any other input.
+			i++
+		default:
+			r, size := utf8.DecodeRune(data[i:])
+			if r == utf8.RuneError && size <= 1 {
+				i++
+				continue
+			}
+			t.put(r)
+			i += size
+		}
+	}
+}
+
+func (t *terminalState) put(r rune) {
+	if t.cursorCol >= t.width {
+		t.cursorCol = 0
+		t.newline()
+	}
+	t.grid[t.cursorRow][t.cursorCol] = TerminalCell{Rune: r, Attr: t.attr}
+	t.cursorCol++
+}
+
+// scanCSI returns how many bytes of data (starting at ESC) make up a CSI
+// sequence "ESC [ params final", and the final byte. If no terminator is
+// found before the end of data — e.g. the sequence was truncated across
+// separate event writes — ok is false and consumed covers the rest of data
+// as a no-op; callers must not index params in that case.
+func scanCSI(data []byte) (consumed int, final byte, ok bool) {
+	for i := 2; i < len(data); i++ {
+		if data[i] >= 0x40 && data[i] <= 0x7e {
+			return i + 1, data[i], true
+		}
+	}
+	return len(data), 0, false
+}
+
+func (t *terminalState) applyCSI(final byte, params []byte) {
+	n, hasN := parseCSIInt(params)
+
+	switch final {
+	case 'H', 'f':
+		row, col := 1, 1
+		if parts := bytes.SplitN(params, []byte(";"), 2); len(parts) == 2 {
+			if v, ok := parseCSIInt(parts[0]); ok {
+				row = v
+			}
+			if v, ok := parseCSIInt(parts[1]); ok {
+				col = v
+			}
+		} else if hasN {
+			row = n
+		}
+		t.cursorRow = clamp(row-1, 0, t.height-1)
+		t.cursorCol = clamp(col-1, 0, t.width-1)
+	case 'A':
+		t.cursorRow = clamp(t.cursorRow-defaultN(n, hasN), 0, t.height-1)
+	case 'B':
+		t.cursorRow = clamp(t.cursorRow+defaultN(n, hasN), 0, t.height-1)
+	case 'C':
+		t.cursorCol = clamp(t.cursorCol+defaultN(n, hasN), 0, t.width-1)
+	case 'D':
+		t.cursorCol = clamp(t.cursorCol-defaultN(n, hasN), 0, t.width-1)
+	case 'm':
+		if !hasN || n == 0 {
+			t.attr = 0
+		} else {
+			t.attr = n
+		}
+	}
+}
+
+func defaultN(n int, hasN bool) int {
+	if !hasN || n == 0 {
+		return 1
+	}
+	return n
+}
+
+func parseCSIInt(b []byte) (int, bool) {
+	n, ok := 0, false
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			break
+		}
+		n = n*10 + int(c-'0')
+		ok = true
+	}
+	return n, ok
+}
+
+func clamp(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+func (t *terminalState) Snapshot() TerminalSnapshot {
+	grid := make([][]TerminalCell, t.height)
+	for i, row := range t.grid {
+		grid[i] = append([]TerminalCell(nil), row...)
+	}
+	return TerminalSnapshot{
+		Width:     t.width,
+		Height:    t.height,
+		CursorRow: t.cursorRow,
+		CursorCol: t.cursorCol,
+		Grid:      grid,
+	}
+}
+
+// IndexWriter builds a .cast.idx sidecar alongside a recording: it replays
+// each written event through a terminalState and checkpoints the screen
+// every DefaultCheckpointInterval or DefaultCheckpointByteWindow, whichever
+// comes first.
+type IndexWriter struct {
+	mu sync.Mutex
+
+	state   *terminalState
+	entries []IndexEntry
+
+	eventCount     int64
+	lastCheckpoint time.Time
+	lastOffset     int64
+
+	interval   time.Duration
+	byteWindow int64
+}
+
+// NewIndexWriter creates an IndexWriter for a header.Width x header.Height
+// terminal using the default checkpoint cadence.
+func NewIndexWriter(width, height int) *IndexWriter {
+	return &IndexWriter{
+		state:      newTerminalState(width, height),
+		interval:   DefaultCheckpointInterval,
+		byteWindow: DefaultCheckpointByteWindow,
+	}
+}
+
+// Observe feeds one written event into the index, checkpointing if enough
+// time or bytes have passed since the last checkpoint. byteOffset is the
+// offset in the recording file immediately after this event was written.
+func (iw *IndexWriter) Observe(eventTime float64, eventType EventType, data []byte, byteOffset int64) {
+	iw.mu.Lock()
+	defer iw.mu.Unlock()
+
+	if eventType == EventOutput {
+		iw.state.Feed(data)
+	}
+	iw.eventCount++
+
+	if iw.lastCheckpoint.IsZero() ||
+		time.Since(iw.lastCheckpoint) >= iw.interval ||
+		byteOffset-iw.lastOffset >= iw.byteWindow {
+		iw.checkpoint(eventTime, byteOffset)
+	}
+}
+
+func (iw *IndexWriter) checkpoint(eventTime float64, byteOffset int64) {
+	snap := iw.state.Snapshot()
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(data); err != nil {
+		return
+	}
+	if err := gz.Close(); err != nil {
+		return
+	}
+
+	iw.entries = append(iw.entries, IndexEntry{
+		EventTime:  eventTime,
+		EventIndex: iw.eventCount,
+		ByteOffset: byteOffset,
+		Snapshot:   buf.Bytes(),
+	})
+	iw.lastCheckpoint = time.Now()
+	iw.lastOffset = byteOffset
+}
+
+// Entries returns the checkpoints recorded so far, oldest first.
+func (iw *IndexWriter) Entries() []IndexEntry {
+	iw.mu.Lock()
+	defer iw.mu.Unlock()
+	return append([]IndexEntry(nil), iw.entries...)
+}
+
+// WriteFile writes the sidecar index for the recording at castPath to
+// castPath+IndexFileSuffix.
+func (iw *IndexWriter) WriteFile(castPath string) error {
+	f, err := os.Create(castPath + IndexFileSuffix)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return json.NewEncoder(f).Encode(iw.Entries())
+}
+
+// LoadIndexFile reads a sidecar index previously written by IndexWriter.
+func LoadIndexFile(path string) ([]IndexEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []IndexEntry
+	if err := json.NewDecoder(f).Decode(&entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// IndexedStreamReader is a StreamReader that can jump directly to a time or
+// event offset using a .cast.idx sidecar, instead of replaying every event
+// from the start of the recording.
+type IndexedStreamReader struct {
+	source  io.ReadSeeker
+	index   []IndexEntry
+	header  *AsciinemaHeader
+	reader  *StreamReader
+	pending *StreamEvent
+
+	snapshot *TerminalSnapshot
+}
+
+// NewIndexedStreamReader reads the recording header from source (which must
+// be positioned at, or is seeked to, the start) and pairs it with index for
+// seeking.
+func NewIndexedStreamReader(source io.ReadSeeker, index []IndexEntry) (*IndexedStreamReader, error) {
+	if _, err := source.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	reader := NewStreamReader(source)
+	ev, err := reader.Next()
+	if err != nil {
+		return nil, err
+	}
+	if ev.Type != "header" || ev.Header == nil {
+		return nil, fmt.Errorf("indexed stream reader: expected header, got %q", ev.Type)
+	}
+
+	return &IndexedStreamReader{
+		source: source,
+		index:  index,
+		header: ev.Header,
+		reader: reader,
+	}, nil
+}
+
+// Snapshot returns the screen snapshot restored by the most recent seek, or
+// nil if no seek has happened yet.
+func (r *IndexedStreamReader) Snapshot() *TerminalSnapshot {
+	return r.snapshot
+}
+
+// Next returns the next event, honoring any pending event buffered by a
+// preceding SeekTime/SeekEvent call.
+func (r *IndexedStreamReader) Next() (*StreamEvent, error) {
+	if r.pending != nil {
+		ev := r.pending
+		r.pending = nil
+		return ev, nil
+	}
+	return r.reader.Next()
+}
+
+// SeekTime jumps to the latest checkpoint taken before t, restores its
+// screen snapshot, then reads forward until the first event at or after t.
+// The next call to Next() returns that event. The events read past on the
+// way are discarded; they are not applied to Snapshot().
+func (r *IndexedStreamReader) SeekTime(t float64) error {
+	entry, ok := latestEntry(r.index, func(e IndexEntry) bool { return e.EventTime < t })
+	if err := r.restore(entry, ok); err != nil {
+		return err
+	}
+
+	for {
+		ev, err := r.reader.Next()
+		if err != nil {
+			return err
+		}
+		if ev.Type == "end" {
+			r.pending = ev
+			return nil
+		}
+		if ev.Type == "event" && ev.Event.Time >= t {
+			r.pending = ev
+			return nil
+		}
+	}
+}
+
+// SeekEvent jumps to the checkpoint nearest to, but not after, the n-th
+// event (0-indexed), restores its screen snapshot, then reads forward to
+// exactly that event. The next call to Next() returns it. The events read
+// past on the way are discarded; they are not applied to Snapshot().
+func (r *IndexedStreamReader) SeekEvent(n int) error {
+	target := int64(n)
+	entry, ok := latestEntry(r.index, func(e IndexEntry) bool { return e.EventIndex <= target })
+	if err := r.restore(entry, ok); err != nil {
+		return err
+	}
+
+	count := int64(0)
+	if ok {
+		count = entry.EventIndex
+	}
+
+	for {
+		ev, err := r.reader.Next()
+		if err != nil {
+			return err
+		}
+		if ev.Type == "end" {
+			r.pending = ev
+			return nil
+		}
+		if ev.Type != "event" {
+			continue
+		}
+		if count >= target {
+			r.pending = ev
+			return nil
+		}
+		count++
+	}
+}
+
+func (r *IndexedStreamReader) restore(entry IndexEntry, ok bool) error {
+	if !ok {
+		if _, err := r.source.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		r.reader = NewStreamReader(r.source)
+		if _, err := r.reader.Next(); err != nil { // consume header
+			return err
+		}
+		r.snapshot = nil
+		return nil
+	}
+
+	snap, err := decodeSnapshot(entry.Snapshot)
+	if err != nil {
+		return err
+	}
+	if _, err := r.source.Seek(entry.ByteOffset, io.SeekStart); err != nil {
+		return err
+	}
+
+	r.reader = newMidStreamReader(r.source, r.header)
+	r.snapshot = snap
+	return nil
+}
+
+// latestEntry returns the last entry (entries are stored oldest-first) for
+// which pred holds.
+func latestEntry(entries []IndexEntry, pred func(IndexEntry) bool) (IndexEntry, bool) {
+	var best IndexEntry
+	found := false
+	for _, e := range entries {
+		if pred(e) {
+			best = e
+			found = true
+		}
+	}
+	return best, found
+}
@@ -0,0 +1,53 @@
+package protocol
+
+import "testing"
+
+// TestScanCSITruncatedSequence guards against the ab3ad00 regression: a CSI
+// sequence with no terminator before the end of data (e.g. split across
+// separate event writes) must not panic, and must report ok=false so
+// terminalState.Feed never indexes params out of bounds.
+func TestScanCSITruncatedSequence(t *testing.T) {
+	cases := [][]byte{
+		{0x1b, '['},
+		{0x1b, '[', '1'},
+		{0x1b, '[', '1', ';'},
+	}
+
+	for _, data := range cases {
+		consumed, _, ok := scanCSI(data)
+		if ok {
+			t.Fatalf("scanCSI(%q): expected ok=false for a truncated sequence", data)
+		}
+		if consumed != len(data) {
+			t.Fatalf("scanCSI(%q): consumed=%d, want %d (rest of data)", data, consumed, len(data))
+		}
+	}
+}
+
+// TestTerminalStateFeedTruncatedCSI is the original panic repro: feeding a
+// truncated CSI sequence directly into terminalState must not panic.
+func TestTerminalStateFeedTruncatedCSI(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Feed panicked on truncated CSI sequence: %v", r)
+		}
+	}()
+
+	ts := newTerminalState(80, 24)
+	ts.Feed([]byte{0x1b, '['})
+	ts.Feed([]byte("\x1b[1;"))
+}
+
+func TestScanCSICompleteSequence(t *testing.T) {
+	data := []byte("\x1b[10;20Hrest")
+	consumed, final, ok := scanCSI(data)
+	if !ok {
+		t.Fatalf("scanCSI(%q): expected ok=true", data)
+	}
+	if final != 'H' {
+		t.Fatalf("scanCSI(%q): final=%q, want 'H'", data, final)
+	}
+	if consumed != len("\x1b[10;20H") {
+		t.Fatalf("scanCSI(%q): consumed=%d, want %d", data, consumed, len("\x1b[10;20H"))
+	}
+}
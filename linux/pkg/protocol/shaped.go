@@ -0,0 +1,154 @@
+package protocol
+
+import (
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ShapeConfig describes the network conditions a ShapedWriter/ShapedReader
+// should emulate, similar to a toxiproxy link toxic.
+type ShapeConfig struct {
+	// BytesPerSec caps sustained throughput. 0 means unlimited.
+	BytesPerSec int
+	// Latency is the fixed delay added before each write/read completes.
+	Latency time.Duration
+	// Jitter is added to or subtracted from Latency at random, uniformly in
+	// [-Jitter, +Jitter].
+	Jitter time.Duration
+	// LossRate is the probability, in [0,1], that a ShapedWriter write is
+	// silently dropped (the caller is told it succeeded).
+	LossRate float64
+	// DupRate is the probability, in [0,1], that a ShapedWriter write is
+	// delivered twice, emulating a duplicating link.
+	DupRate float64
+}
+
+// tokenBucket is a simple byte-rate limiter shared by ShapedWriter and
+// ShapedReader.
+type tokenBucket struct {
+	bytesPerSec float64
+	available   float64
+	last        time.Time
+}
+
+func newTokenBucket(bytesPerSec int) *tokenBucket {
+	return &tokenBucket{bytesPerSec: float64(bytesPerSec)}
+}
+
+// wait blocks until n bytes worth of budget are available, consuming them.
+func (b *tokenBucket) wait(n int, now time.Time) {
+	if b.bytesPerSec <= 0 {
+		return
+	}
+	if b.last.IsZero() {
+		b.last = now
+	}
+	b.available += now.Sub(b.last).Seconds() * b.bytesPerSec
+	if capacity := b.bytesPerSec; b.available > capacity {
+		b.available = capacity
+	}
+	b.last = now
+
+	if deficit := float64(n) - b.available; deficit > 0 {
+		sleep := time.Duration(deficit / b.bytesPerSec * float64(time.Second))
+		time.Sleep(sleep)
+		b.available = 0
+		// The sleep paid off the deficit; don't credit it again next call.
+		b.last = now.Add(sleep)
+	} else {
+		b.available -= float64(n)
+	}
+}
+
+func latencyDelay(cfg ShapeConfig, rng *rand.Rand) time.Duration {
+	delay := cfg.Latency
+	if cfg.Jitter > 0 {
+		offset := time.Duration((rng.Float64()*2 - 1) * float64(cfg.Jitter))
+		delay += offset
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	return delay
+}
+
+// ShapedWriter wraps an io.Writer and applies a ShapeConfig to every write:
+// bandwidth cap, added latency/jitter, and random loss/duplication. It
+// chains transparently with StreamWriter (NewStreamWriter(NewShapedWriter(w,
+// cfg), header)) so callers writing recordings or live output need no
+// changes to exercise poor network conditions.
+type ShapedWriter struct {
+	w      io.Writer
+	cfg    ShapeConfig
+	mu     sync.Mutex
+	bucket *tokenBucket
+	rng    *rand.Rand
+}
+
+// NewShapedWriter wraps w, shaping every Write according to cfg.
+func NewShapedWriter(w io.Writer, cfg ShapeConfig) *ShapedWriter {
+	return &ShapedWriter{
+		w:      w,
+		cfg:    cfg,
+		bucket: newTokenBucket(cfg.BytesPerSec),
+		rng:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (s *ShapedWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cfg.LossRate > 0 && s.rng.Float64() < s.cfg.LossRate {
+		return len(p), nil
+	}
+
+	if delay := latencyDelay(s.cfg, s.rng); delay > 0 {
+		time.Sleep(delay)
+	}
+	s.bucket.wait(len(p), time.Now())
+
+	n, err := s.w.Write(p)
+	if err == nil && s.cfg.DupRate > 0 && s.rng.Float64() < s.cfg.DupRate {
+		_, _ = s.w.Write(p)
+	}
+	return n, err
+}
+
+// ShapedReader wraps an io.Reader and paces reads to a target bitrate with
+// added latency/jitter, useful for replaying a recording as if it were
+// arriving live over a constrained link.
+type ShapedReader struct {
+	r      io.Reader
+	cfg    ShapeConfig
+	mu     sync.Mutex
+	bucket *tokenBucket
+	rng    *rand.Rand
+}
+
+// NewShapedReader wraps r, shaping every Read according to cfg.
+func NewShapedReader(r io.Reader, cfg ShapeConfig) *ShapedReader {
+	return &ShapedReader{
+		r:      r,
+		cfg:    cfg,
+		bucket: newTokenBucket(cfg.BytesPerSec),
+		rng:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (s *ShapedReader) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if delay := latencyDelay(s.cfg, s.rng); delay > 0 {
+		time.Sleep(delay)
+	}
+
+	n, err := s.r.Read(p)
+	if n > 0 {
+		s.bucket.wait(n, time.Now())
+	}
+	return n, err
+}